@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+)
+
+const (
+	ansiRed   = "\x1b[31;1m"
+	ansiReset = "\x1b[0m"
+)
+
+// runAnnotate implements -annotate: a one-shot "why is my function slow"
+// source listing for every function or file matching pattern, with a
+// per-line sample count/percentage gutter and a summary of the hottest line
+// in each function.
+func runAnnotate(stats *ProfileStats, pattern string, highlightThreshold float64) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		fmt.Printf("Bad regex '%s': %s\n", pattern, err)
+		return
+	}
+
+	matched := collectMatchingFunctions(stats, re)
+	if len(matched) == 0 {
+		fmt.Printf("No functions or files matched '%s'\n", pattern)
+		return
+	}
+
+	highlight := stdoutIsTTY()
+
+	for _, functionDef := range matched {
+		annotateFunctionSource(stats, functionDef, highlightThreshold, highlight, true)
+	}
+}
+
+// collectMatchingFunctions returns every function whose name or file matches
+// re, sorted by name for reproducible output order (stats.functions is a
+// map, so iteration order alone isn't stable).
+func collectMatchingFunctions(stats *ProfileStats, re *regexp.Regexp) []FunctionDefinition {
+	var matched []FunctionDefinition
+
+	for functionDef := range stats.functions {
+		if re.MatchString(functionDef.name) || re.MatchString(functionDef.file.filename) {
+			matched = append(matched, functionDef)
+		}
+	}
+
+	sort.Slice(matched, func(i, j int) bool { return matched[i].name < matched[j].name })
+
+	return matched
+}
+
+// lineRangeForFunction finds the span of source lines that carry samples for
+// functionDef, since ProfileStats doesn't otherwise know a function's
+// declaration boundaries.
+func lineRangeForFunction(stats *ProfileStats, functionDef FunctionDefinition) (firstLine, lastLine int, perLine map[int]LineStatistics) {
+	perLine = make(map[int]LineStatistics)
+
+	for lineDef, lineStats := range stats.lines {
+		if lineDef.function != functionDef {
+			continue
+		}
+
+		perLine[lineDef.lineNum] = lineStats
+		if firstLine == 0 || lineDef.lineNum < firstLine {
+			firstLine = lineDef.lineNum
+		}
+		if lineDef.lineNum > lastLine {
+			lastLine = lineDef.lineNum
+		}
+	}
+
+	return
+}
+
+// annotateFunctionSource prints functionDef's source (found under
+// -source-path) with a sample count/percentage gutter per line. When
+// highlight is set, lines whose percentage of stats.overall.count meets
+// highlightThreshold are wrapped in ANSI color. When summary is set, a
+// trailing line reports the function's total samples and hottest address.
+func annotateFunctionSource(stats *ProfileStats, functionDef FunctionDefinition, highlightThreshold float64, highlight bool, summary bool) {
+	firstLine, lastLine, perLine := lineRangeForFunction(stats, functionDef)
+
+	sourceFile, err := openSourceFile(functionDef.file.filename)
+	if err != nil {
+		fmt.Printf("%s: %s (no source available)\n", functionDef.name, err)
+		return
+	}
+	defer sourceFile.Close()
+
+	fmt.Printf("\n%s in %s:\n", functionDef.name, functionDef.file.filename)
+
+	scanner := bufio.NewScanner(sourceFile)
+	lineNum := 0
+
+	var hottestLine int
+	var hottestCount uint32
+	var hottestAddress uint32
+
+	for scanner.Scan() {
+		lineNum++
+		if lineNum < firstLine || lineNum > lastLine {
+			continue
+		}
+
+		lineStats, ok := perLine[lineNum]
+		if !ok {
+			fmt.Printf("%10s %7s %6d: %s\n", "", "", lineNum, scanner.Text())
+			continue
+		}
+
+		percentage := float64(lineStats.count*100) / float64(stats.overall.count)
+		line := fmt.Sprintf("%10d %6.2f%% %6d: %s", lineStats.count, percentage, lineNum, scanner.Text())
+
+		if highlight && percentage >= highlightThreshold {
+			line = ansiRed + line + ansiReset
+		}
+		fmt.Println(line)
+
+		if lineStats.count > hottestCount {
+			hottestCount = lineStats.count
+			hottestLine = lineNum
+			hottestAddress = lineStats.smallestAddress
+		}
+	}
+
+	if summary {
+		functionStats := stats.functions[functionDef]
+		fmt.Printf("  -- %d samples in %s, hottest at line %d (0x%08x)\n",
+			functionStats.count, functionDef.name, hottestLine, hottestAddress)
+	}
+}
+
+// stdoutIsTTY reports whether stdout is a terminal, so -annotate only emits
+// ANSI color when it won't corrupt piped/redirected output.
+func stdoutIsTTY() bool {
+	info, err := os.Stdout.Stat()
+	if err != nil {
+		return false
+	}
+
+	return info.Mode()&os.ModeCharDevice != 0
+}
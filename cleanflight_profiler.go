@@ -7,10 +7,7 @@ import (
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
-	"regexp"
 	"sort"
-	"strconv"
 )
 
 type LogEntry struct {
@@ -22,8 +19,9 @@ type FileDefinition struct {
 }
 
 type FunctionDefinition struct {
-	name string
-	file FileDefinition
+	name     string
+	file     FileDefinition
+	declLine int
 }
 
 type LineDefinition struct {
@@ -31,6 +29,11 @@ type LineDefinition struct {
 	function FunctionDefinition
 }
 
+// FrameChain is the resolved call chain for a single address, ordered from
+// the innermost frame (the "self" attribution, which may be a
+// STATIC_INLINE function) outward to the enclosing real subprogram.
+type FrameChain []LineDefinition
+
 type LineStatistics struct {
 	smallestAddress uint32
 	count           uint32
@@ -45,18 +48,32 @@ type EntityStatistics struct {
 }
 
 type ProfileStats struct {
-	addresses map[AddressDefinition]EntityStatistics
-	lines     map[LineDefinition]LineStatistics
-	functions map[FunctionDefinition]EntityStatistics
-	files     map[FileDefinition]EntityStatistics
+	addresses    map[AddressDefinition]EntityStatistics
+	addressLines map[AddressDefinition]FrameChain
+	lines        map[LineDefinition]LineStatistics
+	functions    map[FunctionDefinition]EntityStatistics
+	files        map[FileDefinition]EntityStatistics
+
+	// inlineFunctions credits only the frames of addressLines that came from
+	// an inlined (DW_TAG_inlined_subroutine) frame rather than the real
+	// enclosing subprogram, so hot STATIC_INLINE helpers can be reported
+	// separately from their call sites instead of being silently folded into
+	// whichever function called them.
+	inlineFunctions map[FunctionDefinition]EntityStatistics
 
 	overall EntityStatistics
 }
 
 var options struct {
-	raw         bool
-	logFilename string
-	exeFilename string
+	raw               bool
+	logFilename       string
+	exeFilename       string
+	outputFormat      string
+	outputFile        string
+	interactive       bool
+	sourcePath        string
+	annotate          string
+	annotateThreshold float64
 }
 
 func parseProfileLog(log io.Reader, output chan *LogEntry) {
@@ -136,136 +153,99 @@ func minU32(a, b uint32) uint32 {
 	return b
 }
 
-func parseLineInfo(addressCounts map[uint32]uint32, pipe io.Reader, stats *ProfileStats, done chan bool) {
-	scanner := bufio.NewScanner(pipe)
+// aggregateProfileStats rebuilds the lines/functions/files/overall aggregates
+// from a set of addresses and their resolved line(s). Besides the initial
+// symbolization pass, this is also what the interactive shell's focus/ignore
+// commands use to recompute aggregates after subsetting stats.addresses.
+func aggregateProfileStats(addresses map[AddressDefinition]EntityStatistics, addressLines map[AddressDefinition]FrameChain) *ProfileStats {
+	result := &ProfileStats{
+		addresses:       make(map[AddressDefinition]EntityStatistics),
+		addressLines:    make(map[AddressDefinition]FrameChain),
+		lines:           make(map[LineDefinition]LineStatistics),
+		functions:       make(map[FunctionDefinition]EntityStatistics),
+		files:           make(map[FileDefinition]EntityStatistics),
+		inlineFunctions: make(map[FunctionDefinition]EntityStatistics),
+	}
 
-	filenameLineSplit, _ := regexp.Compile("^(.+):(\\d+|\\?+)$")
-	pathPrefixRemove, _ := regexp.Compile("^.*/\\./")
+	for addressDef, addressStats := range addresses {
+		result.addresses[addressDef] = addressStats
+		result.addressLines[addressDef] = addressLines[addressDef]
 
-	for {
-		var (
-			address   uint32
-			address64 uint64
-		)
+		for _, lineDef := range addressLines[addressDef] {
+			fileStats := result.files[lineDef.function.file]
+			fileStats.count += addressStats.count
+			result.files[lineDef.function.file] = fileStats
 
-		if !scanner.Scan() {
-			break
-		}
+			functionStats := result.functions[lineDef.function]
+			functionStats.count += addressStats.count
+			result.functions[lineDef.function] = functionStats
 
-		addressLine := scanner.Text()
-		address64, err := strconv.ParseUint(addressLine, 0, 32)
-
-		if err != nil {
-			if len(addressLine) > 0 {
-				fmt.Println(fmt.Sprintf("Bad address '%s', '%s'\n", addressLine, err))
+			lineStats, ok := result.lines[lineDef]
+			if ok {
+				lineStats.smallestAddress = minU32(lineStats.smallestAddress, addressDef.address)
+			} else {
+				lineStats.smallestAddress = addressDef.address
 			}
-			break
-		}
-
-		address = uint32(address64)
-
-		addressCount := addressCounts[address]
-
-		if addressCount < 0 {
-			panic(fmt.Sprintf("addr2line gave us an address 0x%08x which we didn't ask for, '%s'", address, addressLine))
+			lineStats.count += addressStats.count
+			result.lines[lineDef] = lineStats
 		}
 
-		scanner.Scan()
-		functionName := scanner.Text()
-
-		scanner.Scan()
-		filenameLine := scanner.Text()
-
-		matches := filenameLineSplit.FindStringSubmatch(filenameLine)
-
-		if len(matches) < 2 {
-			panic(fmt.Sprintf("Failed to parse filename/line number from '%s'\n", filenameLine, err))
-		}
-
-		filename := pathPrefixRemove.ReplaceAllString(matches[1], "")
-		lineNum, err := strconv.ParseUint(matches[2], 10, 32)
-
-		if err != nil {
-			lineNum = 0
-		}
-
-		fileDef := FileDefinition{filename: filename}
-		functionDef := FunctionDefinition{name: functionName, file: fileDef}
-		lineDef := LineDefinition{function: functionDef, lineNum: int(lineNum)}
-		addressDef := AddressDefinition{address: address}
-
-		fileStats := stats.files[fileDef]
-		fileStats.count += addressCount
-		stats.files[fileDef] = fileStats
-
-		functionStats := stats.functions[functionDef]
-		functionStats.count += addressCount
-		stats.functions[functionDef] = functionStats
-
-		lineStats, ok := stats.lines[lineDef]
-		if ok {
-			lineStats.smallestAddress = minU32(lineStats.smallestAddress, address)
-		} else {
-			lineStats.smallestAddress = address
-		}
-		lineStats.count += addressCount
-		stats.lines[lineDef] = lineStats
-
-		addressStats := stats.addresses[addressDef]
-		addressStats.count = addressCount
-		stats.addresses[addressDef] = addressStats
-
-		stats.overall.count += addressCount
+		result.overall.count += addressStats.count
 	}
 
-	done <- true
+	return result
 }
 
-func translateAddressesToLineStats(addressCounts map[uint32]uint32) (result *ProfileStats) {
-	result = &ProfileStats{
-		addresses: make(map[AddressDefinition]EntityStatistics),
-		lines:     make(map[LineDefinition]LineStatistics),
-		functions: make(map[FunctionDefinition]EntityStatistics),
-		files:     make(map[FileDefinition]EntityStatistics),
-	}
-
-	command := exec.Command("arm-none-eabi-addr2line", "--addresses", "--functions", fmt.Sprintf("--exe=%s", options.exeFilename))
-
-	command.Stderr = os.Stderr
-	stdinPipe, _ := command.StdinPipe()
-	stdoutPipe, _ := command.StdoutPipe()
-
-	err := command.Start()
+// translateAddressesToLineStats symbolizes every observed address directly
+// from the ELF's DWARF debug info (see dwarf.go), rather than shelling out to
+// arm-none-eabi-addr2line. This removes the dependency on the ARM toolchain
+// being on $PATH and is roughly an order of magnitude faster, since the ELF
+// and its line tables are only parsed once.
+func translateAddressesToLineStats(addressCounts map[uint32]uint32) *ProfileStats {
+	symbolizer, err := newDwarfSymbolizer(options.exeFilename)
 	if err != nil {
-		fmt.Printf("\nError: %s\nFailed to run 'arm-none-eabi-addr2line', is it on the $PATH?\n", err)
-		return
+		fmt.Printf("\nError: %s\nFailed to symbolize '%s'\n", err, options.exeFilename)
+		return aggregateProfileStats(nil, nil)
 	}
 
-	// Start reading responses in parallel to avoid deadlock
-	complete := make(chan bool)
+	addresses := make(map[AddressDefinition]EntityStatistics)
+	addressLines := make(map[AddressDefinition]FrameChain)
+	inlineFunctions := make(map[FunctionDefinition]EntityStatistics)
 
-	go parseLineInfo(addressCounts, stdoutPipe, result, complete)
+	for address, addressCount := range addressCounts {
+		chain, inlined := symbolizer.symbolizeFrames(address)
+		addressDef := AddressDefinition{address: address}
 
-	// Send all our requests out for address translation
-	for address, _ := range addressCounts {
-		io.WriteString(stdinPipe, fmt.Sprintf("0x%x\n", address))
-	}
-	stdinPipe.Close()
+		addresses[addressDef] = EntityStatistics{count: addressCount}
+		addressLines[addressDef] = chain
 
-	// Wait for all the replies to get back
-	<-complete
+		for i, lineDef := range chain {
+			if !inlined[i] {
+				continue
+			}
 
-	stdoutPipe.Close()
+			functionStats := inlineFunctions[lineDef.function]
+			functionStats.count += addressCount
+			inlineFunctions[lineDef.function] = functionStats
+		}
+	}
 
-	command.Wait()
+	result := aggregateProfileStats(addresses, addressLines)
+	result.inlineFunctions = inlineFunctions
 
-	return
+	return result
 }
 
 func parseCommandline() bool {
 	flag.BoolVar(&options.raw, "raw", false, "Only print raw addresses, perform no analysis")
 	flag.StringVar(&options.logFilename, "log", "", "Profile log file")
 	flag.StringVar(&options.exeFilename, "elf", "cleanflight_NAZE.elf", "cleanflight_*.elf file that corresponds to the profile")
+	flag.StringVar(&options.outputFormat, "output-format", "text", "Report format to produce: 'text' or 'pprof'")
+	flag.StringVar(&options.outputFile, "o", "profile.pb.gz", "Output file for -output-format pprof")
+	flag.BoolVar(&options.interactive, "interactive", false, "Drop into an interactive pprof-style analysis shell instead of printing a one-shot report")
+	flag.StringVar(&options.sourcePath, "source-path", ".", fmt.Sprintf("Root directories to search for source files for 'list'/'disasm'/-annotate, separated by '%c'", os.PathListSeparator))
+	flag.StringVar(&options.annotate, "annotate", "", "Print source annotated with per-line sample counts for functions/files matching this regex")
+	flag.Float64Var(&options.annotateThreshold, "annotate-threshold", 1.0, "Highlight -annotate lines at or above this percentage of total samples when stdout is a TTY")
 
 	flag.Parse()
 
@@ -277,6 +257,10 @@ func parseCommandline() bool {
 		fmt.Println("Missing elf filename argument")
 		return false
 	}
+	if options.outputFormat != "text" && options.outputFormat != "pprof" {
+		fmt.Printf("Unknown -output-format '%s', expected 'text' or 'pprof'\n", options.outputFormat)
+		return false
+	}
 
 	return true
 }
@@ -401,6 +385,33 @@ func printFileStats(stats *ProfileStats, topN int) {
 	fmt.Println()
 }
 
+// printInlineStats reports which STATIC_INLINE functions are actually
+// dominating cycles, as opposed to being silently folded into whichever
+// function called them (see stats.inlineFunctions in translateAddressesToLineStats).
+func printInlineStats(stats *ProfileStats, topN int) {
+	if len(stats.inlineFunctions) == 0 {
+		return
+	}
+
+	var functions FunctionStatsArray
+
+	fmt.Printf("Top %d inlined functions by sample count:\n\n", topN)
+
+	for def, funcStats := range stats.inlineFunctions {
+		functions = append(functions, FunctionStatsPair{def, funcStats})
+	}
+
+	sort.Sort(functions)
+
+	for i := 0; i < len(functions) && i < topN; i++ {
+		function := functions[i]
+		fmt.Printf("%s:%s - %d samples (%.2f%%)\n", function.def.file.filename,
+			function.def.name, function.stats.count, float32(function.stats.count*100)/float32(stats.overall.count))
+	}
+
+	fmt.Println()
+}
+
 func main() {
 	if !parseCommandline() {
 		return
@@ -423,12 +434,32 @@ func main() {
 
 		stats := translateAddressesToLineStats(addressCounts)
 
-		var maxResults int = 50
-
 		fmt.Printf("%d samples in total\n\n", stats.overall.count)
 
+		if options.outputFormat == "pprof" {
+			if err := writePprofProfile(stats, options.outputFile); err != nil {
+				fmt.Printf("Failed to write pprof profile: %s\n", err)
+				return
+			}
+			fmt.Printf("Wrote pprof profile to '%s'\n", options.outputFile)
+			return
+		}
+
+		if options.annotate != "" {
+			runAnnotate(stats, options.annotate, options.annotateThreshold)
+			return
+		}
+
+		if options.interactive {
+			runInteractive(stats)
+			return
+		}
+
+		var maxResults int = 50
+
 		printLineStats(stats, maxResults)
 		printFunctionStats(stats, maxResults)
 		printFileStats(stats, maxResults)
+		printInlineStats(stats, maxResults)
 	}
 }
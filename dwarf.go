@@ -0,0 +1,346 @@
+package main
+
+import (
+	"debug/dwarf"
+	"debug/elf"
+	"fmt"
+	"sort"
+)
+
+// pcRange is a half-open [low, high) instruction address range.
+type pcRange struct {
+	low, high uint64
+}
+
+func (r pcRange) contains(pc uint64) bool {
+	return pc >= r.low && pc < r.high
+}
+
+func (r pcRange) size() uint64 {
+	return r.high - r.low
+}
+
+// subprogramEntry is a DW_TAG_subprogram or DW_TAG_inlined_subroutine DIE,
+// flattened out of the DIE tree along with the name resolved through any
+// DW_AT_abstract_origin/DW_AT_specification chain.
+type subprogramEntry struct {
+	pcRange
+	name     string
+	declLine int
+	inlined  bool
+	callFile string
+	callLine int
+}
+
+// compileUnit holds everything we need to symbolize a PC that falls inside
+// it: its own range (for binary search), its line table, and the
+// subprogram/inlined-subroutine DIEs found in its subtree.
+type compileUnit struct {
+	pcRange
+	lineReader  *dwarf.LineReader
+	subprograms []subprogramEntry
+}
+
+// dwarfSymbolizer resolves addresses to source locations and function names
+// directly from an ELF's DWARF debug info, replacing the
+// arm-none-eabi-addr2line subprocess pipeline. When the ELF carries no debug
+// info it falls back to the ELF symbol table for function names only.
+type dwarfSymbolizer struct {
+	units      []compileUnit
+	elfSymbols []elf.Symbol
+}
+
+func newDwarfSymbolizer(path string) (*dwarfSymbolizer, error) {
+	elfFile, err := elf.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open '%s': %s", path, err)
+	}
+	defer elfFile.Close()
+
+	sym := &dwarfSymbolizer{}
+
+	if symbols, err := elfFile.Symbols(); err == nil {
+		sym.elfSymbols = symbols
+		sort.Slice(sym.elfSymbols, func(i, j int) bool { return sym.elfSymbols[i].Value < sym.elfSymbols[j].Value })
+	}
+
+	data, err := elfFile.DWARF()
+	if err != nil {
+		// No debug info; we can still symbolize function names from the ELF
+		// symbol table, just not file/line.
+		return sym, nil
+	}
+
+	reader := data.Reader()
+	var currentCU *compileUnit
+
+	for {
+		entry, err := reader.Next()
+		if err != nil || entry == nil {
+			break
+		}
+
+		switch entry.Tag {
+		case dwarf.TagCompileUnit:
+			sym.units = append(sym.units, compileUnit{})
+			currentCU = &sym.units[len(sym.units)-1]
+
+			if low, high, ok := entryPCRange(data, entry); ok {
+				currentCU.pcRange = pcRange{low, high}
+			}
+			if lineReader, err := data.LineReader(entry); err == nil {
+				currentCU.lineReader = lineReader
+			}
+
+		case dwarf.TagSubprogram, dwarf.TagInlinedSubroutine:
+			if currentCU == nil {
+				continue
+			}
+
+			low, high, ok := entryPCRange(data, entry)
+			if !ok {
+				continue
+			}
+
+			subprogram := subprogramEntry{
+				pcRange:  pcRange{low, high},
+				name:     subprogramName(data, entry),
+				declLine: subprogramDeclLine(data, entry),
+				inlined:  entry.Tag == dwarf.TagInlinedSubroutine,
+			}
+
+			if subprogram.inlined {
+				subprogram.callFile, subprogram.callLine = callSite(data, currentCU.lineReader, entry)
+			}
+
+			currentCU.subprograms = append(currentCU.subprograms, subprogram)
+		}
+	}
+
+	sort.Slice(sym.units, func(i, j int) bool { return sym.units[i].low < sym.units[j].low })
+
+	return sym, nil
+}
+
+// entryPCRange extracts the PC range of a DIE that has low_pc/high_pc or
+// ranges attributes, such as TagCompileUnit, TagSubprogram and
+// TagInlinedSubroutine.
+func entryPCRange(data *dwarf.Data, entry *dwarf.Entry) (low, high uint64, ok bool) {
+	if lowpc, lowOk := entry.Val(dwarf.AttrLowpc).(uint64); lowOk {
+		switch highVal := entry.Val(dwarf.AttrHighpc).(type) {
+		case uint64:
+			// Encoded as an absolute address (DW_FORM_addr).
+			return lowpc, highVal, true
+		case int64:
+			// Encoded as an offset from low_pc (DW_FORM_dataN), as emitted by
+			// modern GCC/Clang for DWARF4+.
+			return lowpc, lowpc + uint64(highVal), true
+		}
+	}
+
+	if ranges, err := data.Ranges(entry); err == nil && len(ranges) > 0 {
+		low, high = ranges[0][0], ranges[0][1]
+		for _, r := range ranges[1:] {
+			if r[0] < low {
+				low = r[0]
+			}
+			if r[1] > high {
+				high = r[1]
+			}
+		}
+		return low, high, true
+	}
+
+	return 0, 0, false
+}
+
+// subprogramName resolves a subprogram/inlined-subroutine's name, following
+// DW_AT_abstract_origin/DW_AT_specification references when the DIE itself
+// doesn't carry a DW_AT_name (which is the usual case for inlined
+// subroutines and out-of-line definitions).
+func subprogramName(data *dwarf.Data, entry *dwarf.Entry) string {
+	if name, ok := entry.Val(dwarf.AttrName).(string); ok {
+		return name
+	}
+
+	for _, attr := range [...]dwarf.Attr{dwarf.AttrAbstractOrigin, dwarf.AttrSpecification} {
+		offset, ok := entry.Val(attr).(dwarf.Offset)
+		if !ok {
+			continue
+		}
+
+		reader := data.Reader()
+		reader.Seek(offset)
+		referenced, err := reader.Next()
+		if err != nil || referenced == nil {
+			continue
+		}
+
+		if name := subprogramName(data, referenced); name != "" {
+			return name
+		}
+	}
+
+	return ""
+}
+
+// subprogramDeclLine resolves a subprogram/inlined-subroutine's declaration
+// line from its DW_AT_decl_line attribute, following
+// DW_AT_abstract_origin/DW_AT_specification references when the DIE itself
+// doesn't carry one directly (the usual case for inlined subroutines, which
+// only record the call site and leave the declaration on the abstract
+// origin).
+func subprogramDeclLine(data *dwarf.Data, entry *dwarf.Entry) int {
+	if line, ok := entry.Val(dwarf.AttrDeclLine).(int64); ok {
+		return int(line)
+	}
+
+	for _, attr := range [...]dwarf.Attr{dwarf.AttrAbstractOrigin, dwarf.AttrSpecification} {
+		offset, ok := entry.Val(attr).(dwarf.Offset)
+		if !ok {
+			continue
+		}
+
+		reader := data.Reader()
+		reader.Seek(offset)
+		referenced, err := reader.Next()
+		if err != nil || referenced == nil {
+			continue
+		}
+
+		if line := subprogramDeclLine(data, referenced); line != 0 {
+			return line
+		}
+	}
+
+	return 0
+}
+
+// callSite resolves the file/line of an inlined subroutine's call site from
+// its DW_AT_call_file/DW_AT_call_line attributes, which index into the
+// enclosing compile unit's line table file list.
+func callSite(data *dwarf.Data, lineReader *dwarf.LineReader, entry *dwarf.Entry) (file string, line int) {
+	fileIdx, ok := entry.Val(dwarf.AttrCallFile).(int64)
+	if !ok || lineReader == nil {
+		return "", 0
+	}
+
+	files := lineReader.Files()
+	if fileIdx < 0 || int(fileIdx) >= len(files) || files[fileIdx] == nil {
+		return "", 0
+	}
+
+	callLine, _ := entry.Val(dwarf.AttrCallLine).(int64)
+
+	return files[fileIdx].Name, int(callLine)
+}
+
+func (s *dwarfSymbolizer) cuForPC(pc uint64) *compileUnit {
+	idx := sort.Search(len(s.units), func(i int) bool { return s.units[i].low > pc })
+	if idx == 0 {
+		return nil
+	}
+
+	cu := &s.units[idx-1]
+	if cu.contains(pc) {
+		return cu
+	}
+
+	return nil
+}
+
+// framesForPC returns every subprogram/inlined-subroutine DIE in the owning
+// compile unit whose range covers pc, ordered from outermost (the real,
+// non-inlined subprogram) to innermost (the deepest inlined call), so a
+// single PC can resolve to more than one logical frame.
+func (cu *compileUnit) framesForPC(pc uint64) []subprogramEntry {
+	var frames []subprogramEntry
+
+	for _, subprogram := range cu.subprograms {
+		if subprogram.contains(pc) {
+			frames = append(frames, subprogram)
+		}
+	}
+
+	sort.Slice(frames, func(i, j int) bool { return frames[i].size() > frames[j].size() })
+
+	return frames
+}
+
+// elfSymbolForPC falls back to the ELF symbol table to name a function when
+// there's no DWARF debug info covering pc.
+func (s *dwarfSymbolizer) elfSymbolForPC(pc uint64) string {
+	idx := sort.Search(len(s.elfSymbols), func(i int) bool { return s.elfSymbols[i].Value > pc })
+	if idx == 0 {
+		return ""
+	}
+
+	symbol := s.elfSymbols[idx-1]
+	if symbol.Size > 0 && pc >= symbol.Value+symbol.Size {
+		return ""
+	}
+
+	return symbol.Name
+}
+
+// symbolize resolves a single address to its self (innermost) function, file
+// and line, falling back to the ELF symbol table when there's no debug info.
+func (s *dwarfSymbolizer) symbolize(pc uint32) (functionName, filename string, lineNum int) {
+	chain, _ := s.symbolizeFrames(pc)
+	self := chain[0]
+
+	return self.function.name, self.function.file.filename, self.lineNum
+}
+
+// symbolizeFrames resolves pc to its full inlining chain, ordered from the
+// innermost frame (index 0, the "self" attribution - possibly a
+// STATIC_INLINE function) outward to the enclosing real subprogram. The
+// returned bool slice marks which chain entries came from a
+// DW_TAG_inlined_subroutine DIE rather than the real subprogram.
+//
+// Each inlined frame's file/line is the call site recorded on the next
+// frame in, i.e. frame N's source location is "where frame N called frame
+// N-1", except frame 0 whose location is the line table's entry for pc
+// itself.
+func (s *dwarfSymbolizer) symbolizeFrames(pc uint32) (chain FrameChain, inlined []bool) {
+	address := uint64(pc)
+
+	cu := s.cuForPC(address)
+	if cu == nil {
+		return FrameChain{{function: FunctionDefinition{name: s.elfSymbolForPC(address), file: FileDefinition{filename: "?"}}}}, []bool{false}
+	}
+
+	file, lineNum := "", 0
+	var line dwarf.LineEntry
+	if cu.lineReader != nil {
+		if err := cu.lineReader.SeekPC(address, &line); err == nil {
+			file, lineNum = line.File.Name, line.Line
+		}
+	}
+
+	frames := cu.framesForPC(address) // outermost..innermost
+	if len(frames) == 0 {
+		functionName := s.elfSymbolForPC(address)
+		return FrameChain{{function: FunctionDefinition{name: functionName, file: FileDefinition{filename: file}}, lineNum: lineNum}}, []bool{false}
+	}
+
+	chain = make(FrameChain, len(frames))
+	inlined = make([]bool, len(frames))
+
+	for i := len(frames) - 1; i >= 0; i-- {
+		frame := frames[i]
+		out := len(frames) - 1 - i // 0 == innermost
+
+		chain[out] = LineDefinition{
+			function: FunctionDefinition{name: frame.name, file: FileDefinition{filename: file}, declLine: frame.declLine},
+			lineNum:  lineNum,
+		}
+		inlined[out] = frame.inlined
+
+		if frame.inlined {
+			file, lineNum = frame.callFile, frame.callLine
+		}
+	}
+
+	return chain, inlined
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// runInteractive drops the user into a small pprof-driver-style REPL over an
+// already-symbolized profile, so they can explore a profile without leaving
+// the process: `top [N]`, `list <funcregex>`, `disasm <funcregex>`,
+// `focus <regex>`, `ignore <regex>`, `web` and `quit`.
+func runInteractive(stats *ProfileStats) {
+	current := stats
+	scanner := bufio.NewScanner(os.Stdin)
+
+	fmt.Println("Entering interactive mode, type 'help' for a list of commands")
+
+	for {
+		fmt.Print("(profiler) ")
+
+		if !scanner.Scan() {
+			break
+		}
+
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+
+		command, args := fields[0], fields[1:]
+
+		switch command {
+		case "quit", "exit":
+			return
+
+		case "help":
+			printInteractiveHelp()
+
+		case "top":
+			topN := 10
+			if len(args) > 0 {
+				if n, err := strconv.Atoi(args[0]); err == nil {
+					topN = n
+				}
+			}
+			printFunctionStats(current, topN)
+
+		case "list":
+			if len(args) == 0 {
+				fmt.Println("Usage: list <funcregex>")
+				continue
+			}
+			listFunction(current, args[0])
+
+		case "disasm":
+			if len(args) == 0 {
+				fmt.Println("Usage: disasm <funcregex>")
+				continue
+			}
+			disassembleFunction(current, args[0])
+
+		case "focus":
+			if len(args) == 0 {
+				fmt.Println("Usage: focus <regex>")
+				continue
+			}
+			current = filterProfileStats(current, args[0], true)
+
+		case "ignore":
+			if len(args) == 0 {
+				fmt.Println("Usage: ignore <regex>")
+				continue
+			}
+			current = filterProfileStats(current, args[0], false)
+
+		case "web":
+			if err := renderWebGraph(current); err != nil {
+				fmt.Printf("Failed to render web graph: %s\n", err)
+			}
+
+		default:
+			fmt.Printf("Unknown command '%s', type 'help' for a list of commands\n", command)
+		}
+	}
+}
+
+func printInteractiveHelp() {
+	fmt.Println(`Commands:
+  top [N]           Show the top N functions by sample count (default 10)
+  list <funcregex>  Show annotated source for functions matching funcregex
+  disasm <funcregex> Show annotated disassembly for functions matching funcregex
+  focus <regex>     Keep only samples in functions/files matching regex
+  ignore <regex>    Drop samples in functions/files matching regex
+  web               Render a Graphviz file/function graph and open it
+  quit              Exit the interactive shell`)
+}
+
+// filterProfileStats keeps (focus) or drops (ignore) every address whose
+// resolved function name or file name matches regex, then recomputes
+// aggregates over the surviving addresses.
+func filterProfileStats(stats *ProfileStats, pattern string, keepMatches bool) *ProfileStats {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		fmt.Printf("Bad regex '%s': %s\n", pattern, err)
+		return stats
+	}
+
+	addresses := make(map[AddressDefinition]EntityStatistics)
+	addressLines := make(map[AddressDefinition]FrameChain)
+
+	for addressDef, addressStats := range stats.addresses {
+		matched := false
+		for _, lineDef := range stats.addressLines[addressDef] {
+			if re.MatchString(lineDef.function.name) || re.MatchString(lineDef.function.file.filename) {
+				matched = true
+				break
+			}
+		}
+
+		if matched != keepMatches {
+			continue
+		}
+
+		addresses[addressDef] = addressStats
+		addressLines[addressDef] = stats.addressLines[addressDef]
+	}
+
+	result := aggregateProfileStats(addresses, addressLines)
+	fmt.Printf("%d samples remaining\n", result.overall.count)
+
+	return result
+}
+
+// listFunction prints the source of every function matching regex, with a
+// per-line sample count and percentage-of-total gutter.
+func listFunction(stats *ProfileStats, pattern string) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		fmt.Printf("Bad regex '%s': %s\n", pattern, err)
+		return
+	}
+
+	matchedAny := false
+
+	for functionDef := range stats.functions {
+		if !re.MatchString(functionDef.name) {
+			continue
+		}
+		matchedAny = true
+
+		listOneFunction(stats, functionDef)
+	}
+
+	if !matchedAny {
+		fmt.Printf("No functions matched '%s'\n", pattern)
+	}
+}
+
+func listOneFunction(stats *ProfileStats, functionDef FunctionDefinition) {
+	annotateFunctionSource(stats, functionDef, 0, false, false)
+}
+
+// openSourceFile searches for filename under -source-path, since the path
+// embedded in the DWARF info is whatever the compiler was invoked with and
+// usually won't exist as-is on the machine running the profiler.
+func openSourceFile(filename string) (*os.File, error) {
+	if filepath.IsAbs(filename) {
+		if f, err := os.Open(filename); err == nil {
+			return f, nil
+		}
+	}
+
+	for _, root := range sourcePathRoots() {
+		if f, err := os.Open(filepath.Join(root, filename)); err == nil {
+			return f, nil
+		}
+	}
+
+	return nil, fmt.Errorf("'%s' not found under -source-path", filename)
+}
+
+func sourcePathRoots() []string {
+	return strings.Split(options.sourcePath, string(os.PathListSeparator))
+}
+
+var objdumpLineRegexp = regexp.MustCompile(`^\s*([0-9a-fA-F]+):\s*(.*)$`)
+var objdumpFuncHeaderRegexp = regexp.MustCompile(`^[0-9a-fA-F]+ <([^>]+)>:$`)
+
+// disassembleFunction runs arm-none-eabi-objdump over the ELF and prints the
+// disassembly block for every function matching regex, annotating each
+// instruction with the sample count observed at that address.
+func disassembleFunction(stats *ProfileStats, pattern string) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		fmt.Printf("Bad regex '%s': %s\n", pattern, err)
+		return
+	}
+
+	output, err := exec.Command("arm-none-eabi-objdump", "-d", "--no-show-raw-insn", options.exeFilename).Output()
+	if err != nil {
+		fmt.Printf("Failed to run 'arm-none-eabi-objdump': %s\n", err)
+		return
+	}
+
+	inMatchedFunction := false
+	matchedAny := false
+
+	for _, line := range strings.Split(string(output), "\n") {
+		if header := objdumpFuncHeaderRegexp.FindStringSubmatch(line); header != nil {
+			inMatchedFunction = re.MatchString(header[1])
+			if inMatchedFunction {
+				matchedAny = true
+				fmt.Println()
+			}
+		}
+
+		if !inMatchedFunction {
+			continue
+		}
+
+		if match := objdumpLineRegexp.FindStringSubmatch(line); match != nil {
+			address, err := strconv.ParseUint(match[1], 16, 32)
+			if err == nil {
+				if addressStats, ok := stats.addresses[AddressDefinition{address: uint32(address)}]; ok {
+					fmt.Printf("%10d  %s\n", addressStats.count, line)
+					continue
+				}
+			}
+		}
+
+		fmt.Printf("%10s  %s\n", "", line)
+	}
+
+	if !matchedAny {
+		fmt.Printf("No functions matched '%s'\n", pattern)
+	}
+}
+
+// renderWebGraph renders a Graphviz file -> function graph, weighted by
+// sample count, to a temporary SVG and opens it in the default viewer.
+func renderWebGraph(stats *ProfileStats) error {
+	var functions FunctionStatsArray
+	for def, s := range stats.functions {
+		functions = append(functions, FunctionStatsPair{def, s})
+	}
+	sort.Sort(functions)
+
+	var dot strings.Builder
+	dot.WriteString("digraph profile {\n")
+	dot.WriteString("  rankdir=LR;\n  node [shape=box];\n")
+
+	seenFiles := make(map[string]bool)
+
+	for _, function := range functions {
+		if !seenFiles[function.def.file.filename] {
+			seenFiles[function.def.file.filename] = true
+			fmt.Fprintf(&dot, "  %q [shape=folder];\n", function.def.file.filename)
+		}
+
+		label := fmt.Sprintf("%s\\n%d samples", function.def.name, function.stats.count)
+		fmt.Fprintf(&dot, "  %q [label=%q];\n", function.def.name, label)
+		fmt.Fprintf(&dot, "  %q -> %q;\n", function.def.file.filename, function.def.name)
+	}
+
+	dot.WriteString("}\n")
+
+	svgFile, err := os.CreateTemp("", "cleanflight-profiler-*.svg")
+	if err != nil {
+		return err
+	}
+	svgFile.Close()
+
+	dotCommand := exec.Command("dot", "-Tsvg", "-o", svgFile.Name())
+	dotCommand.Stdin = strings.NewReader(dot.String())
+	dotCommand.Stderr = os.Stderr
+	if err := dotCommand.Run(); err != nil {
+		return fmt.Errorf("failed to run 'dot', is Graphviz installed? %s", err)
+	}
+
+	return openInBrowser(svgFile.Name())
+}
+
+func openInBrowser(path string) error {
+	var command string
+	switch runtime.GOOS {
+	case "darwin":
+		command = "open"
+	case "windows":
+		command = "start"
+	default:
+		command = "xdg-open"
+	}
+
+	return exec.Command(command, path).Start()
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"debug/elf"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+)
+
+// protoWriter accumulates a protobuf wire-format message. Submessages are
+// built bottom-up into their own byte slices and then embedded with
+// bytesField, since the profile.proto messages nest cleanly that way.
+type protoWriter struct {
+	bytes.Buffer
+}
+
+func (w *protoWriter) varint(v uint64) {
+	for v >= 0x80 {
+		w.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	w.WriteByte(byte(v))
+}
+
+func (w *protoWriter) tag(field int, wireType int) {
+	w.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (w *protoWriter) uint64Field(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, 0)
+	w.varint(v)
+}
+
+func (w *protoWriter) int64Field(field int, v int64) {
+	if v == 0 {
+		return
+	}
+	w.tag(field, 0)
+	w.varint(uint64(v))
+}
+
+func (w *protoWriter) boolField(field int, v bool) {
+	if !v {
+		return
+	}
+	w.tag(field, 0)
+	w.varint(1)
+}
+
+func (w *protoWriter) bytesField(field int, v []byte) {
+	if len(v) == 0 {
+		return
+	}
+	w.tag(field, 2)
+	w.varint(uint64(len(v)))
+	w.Write(v)
+}
+
+// repeatedStringField writes a length-delimited field unconditionally, even
+// when v is empty. Unlike bytesField (where omitting a zero-length
+// submessage is the correct encoding for an unset optional field),
+// string_table entries are positional: skipping the empty string at index 0
+// would shift every other interned index down by one.
+func (w *protoWriter) repeatedStringField(field int, v string) {
+	w.tag(field, 2)
+	w.varint(uint64(len(v)))
+	w.WriteString(v)
+}
+
+// pprofStringTable interns strings into a pprof string_table, where index 0
+// is reserved by the format to mean "empty string".
+type pprofStringTable struct {
+	strings []string
+	indices map[string]int64
+}
+
+func newPprofStringTable() *pprofStringTable {
+	return &pprofStringTable{
+		strings: []string{""},
+		indices: map[string]int64{"": 0},
+	}
+}
+
+func (t *pprofStringTable) intern(s string) int64 {
+	if idx, ok := t.indices[s]; ok {
+		return idx
+	}
+	idx := int64(len(t.strings))
+	t.strings = append(t.strings, s)
+	t.indices[s] = idx
+	return idx
+}
+
+// pprofLine is one resolved (function, line) pair contributing to a Location.
+type pprofLine struct {
+	functionID uint64
+	lineNum    int64
+}
+
+func encodePprofFunction(id uint64, name, filename string, startLine int64, strTable *pprofStringTable) []byte {
+	var w protoWriter
+	w.uint64Field(1, id)
+	w.int64Field(2, strTable.intern(name))
+	w.int64Field(3, strTable.intern(name))
+	w.int64Field(4, strTable.intern(filename))
+	w.int64Field(5, startLine)
+	return w.Bytes()
+}
+
+func encodePprofLocation(id uint64, mappingID uint64, address uint64, lines []pprofLine) []byte {
+	var w protoWriter
+	w.uint64Field(1, id)
+	w.uint64Field(2, mappingID)
+	w.uint64Field(3, address)
+	for _, line := range lines {
+		var lw protoWriter
+		lw.uint64Field(1, line.functionID)
+		lw.int64Field(2, line.lineNum)
+		w.bytesField(4, lw.Bytes())
+	}
+	return w.Bytes()
+}
+
+func encodePprofSample(locationIDs []uint64, value int64) []byte {
+	var w protoWriter
+	for _, id := range locationIDs {
+		w.uint64Field(1, id)
+	}
+	w.int64Field(2, value)
+	return w.Bytes()
+}
+
+func encodePprofValueType(typ, unit string, strTable *pprofStringTable) []byte {
+	var w protoWriter
+	w.int64Field(1, strTable.intern(typ))
+	w.int64Field(2, strTable.intern(unit))
+	return w.Bytes()
+}
+
+func encodePprofMapping(id uint64, start, limit, offset uint64, filename, buildID string, strTable *pprofStringTable) []byte {
+	var w protoWriter
+	w.uint64Field(1, id)
+	w.uint64Field(2, start)
+	w.uint64Field(3, limit)
+	w.uint64Field(4, offset)
+	w.int64Field(5, strTable.intern(filename))
+	w.int64Field(6, strTable.intern(buildID))
+	w.boolField(7, true)   // has_functions
+	w.boolField(8, true)   // has_filenames
+	w.boolField(9, true)   // has_line_numbers
+	w.boolField(10, false) // has_inline_frames
+	return w.Bytes()
+}
+
+// elfBuildID reads the desc bytes out of the .note.gnu.build-id section, if
+// the ELF has one, and returns them hex-encoded as readelf/pprof do.
+func elfBuildID(f *elf.File) string {
+	section := f.Section(".note.gnu.build-id")
+	if section == nil {
+		return ""
+	}
+
+	data, err := section.Data()
+	if err != nil || len(data) < 12 {
+		return ""
+	}
+
+	nameSize := f.ByteOrder.Uint32(data[0:4])
+	descSize := f.ByteOrder.Uint32(data[4:8])
+
+	descOffset := 12 + align4(nameSize)
+	if descOffset+descSize > uint32(len(data)) {
+		return ""
+	}
+
+	return hex.EncodeToString(data[descOffset : descOffset+descSize])
+}
+
+func align4(v uint32) uint32 {
+	return (v + 3) &^ 3
+}
+
+// elfTextRange returns the address range spanned by the executable PT_LOAD
+// segments, which is what pprof's Mapping.memory_start/memory_limit expect.
+func elfTextRange(f *elf.File) (start, limit uint64) {
+	haveRange := false
+
+	for _, prog := range f.Progs {
+		if prog.Type != elf.PT_LOAD || prog.Flags&elf.PF_X == 0 {
+			continue
+		}
+
+		end := prog.Vaddr + prog.Memsz
+
+		if !haveRange {
+			start, limit = prog.Vaddr, end
+			haveRange = true
+			continue
+		}
+
+		if prog.Vaddr < start {
+			start = prog.Vaddr
+		}
+		if end > limit {
+			limit = end
+		}
+	}
+
+	return start, limit
+}
+
+// buildPprofProfile renders stats as a gzipped pprof v3 profile.proto Profile
+// with one "samples"/"count" sample per address, so the result can be fed
+// straight into `go tool pprof` or Speedscope for symbolization, flame
+// graphs and diffing.
+func buildPprofProfile(stats *ProfileStats) ([]byte, error) {
+	elfFile, err := elf.Open(options.exeFilename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open '%s' for pprof mapping info: %s", options.exeFilename, err)
+	}
+	defer elfFile.Close()
+
+	strTable := newPprofStringTable()
+
+	var functions, locations, samples [][]byte
+	functionIDs := make(map[FunctionDefinition]uint64)
+	var nextFunctionID uint64 = 1
+
+	const mappingID = 1
+	mappingStart, mappingLimit := elfTextRange(elfFile)
+	mapping := encodePprofMapping(mappingID, mappingStart, mappingLimit, 0, options.exeFilename, elfBuildID(elfFile), strTable)
+
+	var nextLocationID uint64 = 1
+
+	for addressDef, addressStats := range stats.addresses {
+		lineDefs := stats.addressLines[addressDef]
+
+		var lines []pprofLine
+		for _, lineDef := range lineDefs {
+			functionID, ok := functionIDs[lineDef.function]
+			if !ok {
+				functionID = nextFunctionID
+				nextFunctionID++
+				functionIDs[lineDef.function] = functionID
+				functions = append(functions, encodePprofFunction(functionID, lineDef.function.name, lineDef.function.file.filename, int64(lineDef.function.declLine), strTable))
+			}
+
+			lines = append(lines, pprofLine{functionID: functionID, lineNum: int64(lineDef.lineNum)})
+		}
+
+		locationID := nextLocationID
+		nextLocationID++
+		locations = append(locations, encodePprofLocation(locationID, mappingID, uint64(addressDef.address), lines))
+		samples = append(samples, encodePprofSample([]uint64{locationID}, int64(addressStats.count)))
+	}
+
+	var w protoWriter
+	w.bytesField(1, encodePprofValueType("samples", "count", strTable))
+	for _, sample := range samples {
+		w.bytesField(2, sample)
+	}
+	w.bytesField(3, mapping)
+	for _, location := range locations {
+		w.bytesField(4, location)
+	}
+	for _, function := range functions {
+		w.bytesField(5, function)
+	}
+	for _, s := range strTable.strings {
+		w.repeatedStringField(6, s)
+	}
+
+	var gzipped bytes.Buffer
+	gzWriter := gzip.NewWriter(&gzipped)
+	if _, err := gzWriter.Write(w.Bytes()); err != nil {
+		return nil, fmt.Errorf("failed to gzip pprof profile: %s", err)
+	}
+	if err := gzWriter.Close(); err != nil {
+		return nil, fmt.Errorf("failed to gzip pprof profile: %s", err)
+	}
+
+	return gzipped.Bytes(), nil
+}
+
+func writePprofProfile(stats *ProfileStats, path string) error {
+	data, err := buildPprofProfile(stats)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(path, data, 0644)
+}
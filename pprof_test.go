@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/google/pprof/profile"
+)
+
+// TestBuildPprofProfileRoundTrips exercises the full encode path and feeds
+// the result back through the real profile.proto unmarshaler, catching
+// wire-format bugs (like a shifted string_table) that a hand inspection of
+// the writer code won't.
+func TestBuildPprofProfileRoundTrips(t *testing.T) {
+	previous := options.exeFilename
+	options.exeFilename = os.Args[0] // any valid ELF; its own contents are irrelevant here
+	defer func() { options.exeFilename = previous }()
+
+	pidFunc := FunctionDefinition{name: "pidController", file: FileDefinition{filename: "pid.c"}, declLine: 42}
+	mixerFunc := FunctionDefinition{name: "mixTable", file: FileDefinition{filename: "mixer.c"}, declLine: 7}
+
+	stats := aggregateProfileStats(
+		map[AddressDefinition]EntityStatistics{
+			{address: 0x1000}: {count: 30},
+			{address: 0x2000}: {count: 10},
+		},
+		map[AddressDefinition]FrameChain{
+			{address: 0x1000}: {{function: pidFunc, lineNum: 100}},
+			{address: 0x2000}: {{function: mixerFunc, lineNum: 55}},
+		},
+	)
+
+	data, err := buildPprofProfile(stats)
+	if err != nil {
+		t.Fatalf("buildPprofProfile: %s", err)
+	}
+
+	parsed, err := profile.Parse(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("profile.Parse rejected the output (e.g. a shifted string_table): %s", err)
+	}
+
+	if len(parsed.SampleType) != 1 || parsed.SampleType[0].Type != "samples" || parsed.SampleType[0].Unit != "count" {
+		t.Fatalf("unexpected sample_type: %+v", parsed.SampleType)
+	}
+
+	if len(parsed.Mapping) != 1 || parsed.Mapping[0].File != os.Args[0] {
+		t.Fatalf("mapping did not round-trip the ELF path: %+v", parsed.Mapping)
+	}
+
+	gotFunctions := map[string]struct {
+		filename  string
+		startLine int64
+	}{}
+	for _, f := range parsed.Function {
+		gotFunctions[f.Name] = struct {
+			filename  string
+			startLine int64
+		}{f.Filename, f.StartLine}
+	}
+
+	if got, ok := gotFunctions["pidController"]; !ok || got.filename != "pid.c" || got.startLine != 42 {
+		t.Fatalf("pidController function did not round-trip: %+v (ok=%v)", got, ok)
+	}
+	if got, ok := gotFunctions["mixTable"]; !ok || got.filename != "mixer.c" || got.startLine != 7 {
+		t.Fatalf("mixTable function did not round-trip: %+v (ok=%v)", got, ok)
+	}
+
+	var total int64
+	for _, sample := range parsed.Sample {
+		total += sample.Value[0]
+	}
+	if total != 40 {
+		t.Fatalf("expected sample values to total 40, got %d", total)
+	}
+}